@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 )
 
 type actionAvailableError struct {
@@ -19,14 +20,30 @@ type serviceMapError struct {
 	Service string
 }
 
+// healthTimeoutError indicates a service did not become healthy within the
+// configured --health-timeout, and the batch containing it should be rolled
+// back rather than continued.
+type healthTimeoutError struct {
+	Service string
+	Timeout time.Duration
+}
+
 func (e *actionAvailableError) Error() string {
 	return fmt.Sprintf("Action %s is not available on service %s", e.Action, e.Service)
 }
 
 func (e *upgradeError) Error() string {
-	return fmt.Sprintf("Error trying to upgrade %s during the %s action.\n\n%e", e.Service, e.Action, e.Err)
+	return fmt.Errorf("error trying to upgrade %s during the %s action: %w", e.Service, e.Action, e.Err).Error()
+}
+
+func (e *upgradeError) Unwrap() error {
+	return e.Err
 }
 
 func (e *serviceMapError) Error() string {
 	return fmt.Sprintf("Error getting service %s from the servicemap.", e.Service)
 }
+
+func (e *healthTimeoutError) Error() string {
+	return fmt.Sprintf("Service %s did not become healthy within %s.", e.Service, e.Timeout)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"strings"
+)
+
+// InitializeLogging builds the *zap.Logger used for the lifetime of the
+// process. logFormat selects "json" or "console" encoding; logFile, when
+// set, writes to a rotated file instead of stdout.
+func InitializeLogging(logLevel, logFormat, logFile string) *zap.Logger {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "ts"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	if strings.ToLower(logFormat) == "console" {
+		consoleCfg := zap.NewDevelopmentEncoderConfig()
+		consoleCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+		encoder = zapcore.NewConsoleEncoder(consoleCfg)
+	} else {
+		encoder = zapcore.NewJSONEncoder(encoderCfg)
+	}
+
+	var writer zapcore.WriteSyncer
+	if logFile != "" {
+		writer = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   logFile,
+			MaxSize:    100, // megabytes
+			MaxBackups: 5,
+			MaxAge:     28, // days
+			Compress:   true,
+		})
+	} else {
+		writer = zapcore.AddSync(os.Stdout)
+	}
+
+	core := zapcore.NewCore(encoder, writer, parseLevel(logLevel))
+	return zap.New(core)
+}
+
+func parseLevel(logLevel string) zapcore.Level {
+	switch strings.ToLower(logLevel) {
+	case "panic":
+		return zapcore.PanicLevel
+	case "fatal":
+		return zapcore.FatalLevel
+	case "error":
+		return zapcore.ErrorLevel
+	case "warn":
+		return zapcore.WarnLevel
+	case "debug":
+		return zapcore.DebugLevel
+	case "info":
+		fallthrough
+	default:
+		return zapcore.InfoLevel
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ProgressState is a state in a service's upgrade lifecycle.
+type ProgressState int
+
+const (
+	Queued ProgressState = iota
+	Upgrading
+	FinishingUpgrade
+	Done
+	Failed
+	// DryRun is terminal like Done, but reports that --dry-run stopped the
+	// service short of actually upgrading it, once its image digest (if
+	// any) was resolved.
+	DryRun
+)
+
+func (s ProgressState) String() string {
+	switch s {
+	case Queued:
+		return "Queued"
+	case Upgrading:
+		return "Upgrading"
+	case FinishingUpgrade:
+		return "FinishingUpgrade"
+	case Done:
+		return "Done"
+	case Failed:
+		return "Failed"
+	case DryRun:
+		return "DryRun"
+	default:
+		return "Unknown"
+	}
+}
+
+// Succeeded reports whether s is a terminal state that didn't fail, i.e.
+// Done or DryRun. Used to decide whether a --manifest dependent should
+// proceed and whether the run as a whole should be reported as failed.
+func (s ProgressState) Succeeded() bool {
+	return s == Done || s == DryRun
+}
+
+// Progress is a single state transition emitted for a service's upgrade.
+type Progress struct {
+	Service string
+	State   ProgressState
+	Attempt int
+	Err     error
+}
+
+// upgradeJob tracks the in-flight run for a single service so that
+// concurrent requests to upgrade the same service join the same run
+// instead of racing each other.
+type upgradeJob struct {
+	watchers []chan Progress
+}
+
+// UpgradeManager schedules service upgrades the way Docker's transfer
+// manager schedules image pulls: a duplicate request for a service already
+// in flight subscribes to that run instead of starting a second one, a
+// semaphore bounds global concurrency, and a failed run is retried with
+// exponential backoff before being reported as Failed.
+type UpgradeManager struct {
+	ctx        context.Context
+	prefix     string
+	tag        string
+	opts       *UpgradeOptions
+	maxRetries int
+	sem        chan struct{}
+	logger     *zap.Logger
+
+	mu                 sync.Mutex
+	jobs               map[string]*upgradeJob
+	imageOverrides     map[string]string
+	batchSizeOverrides map[string]int64
+}
+
+// SetOverrides lets a caller (the --manifest driver) override the image and
+// batch size used for specific services instead of the manager's defaults.
+func (m *UpgradeManager) SetOverrides(imageOverrides map[string]string, batchSizeOverrides map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.imageOverrides = imageOverrides
+	m.batchSizeOverrides = batchSizeOverrides
+}
+
+func (m *UpgradeManager) imageForService(service string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if image, ok := m.imageOverrides[service]; ok {
+		return image
+	}
+	return m.prefix + service + m.tag
+}
+
+func (m *UpgradeManager) optsForService(service string) *UpgradeOptions {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	opts := *m.opts
+	if batchSize, ok := m.batchSizeOverrides[service]; ok {
+		opts.BatchSize = batchSize
+	}
+	return &opts
+}
+
+// NewUpgradeManager builds an UpgradeManager that upgrades to prefix+service+tag,
+// running at most parallelism upgrades at once and retrying a failed service
+// up to maxRetries times. When --pause-between-batches is set, parallelism is
+// forced to 1: confirmNextBatch blocks on stdin, and letting more than one
+// service wait on that read at a time means a single Enter keypress unblocks
+// an arbitrary one of them instead of advancing the rollout one service at a
+// time as the flag promises.
+func NewUpgradeManager(ctx context.Context, prefix, tag string, opts *UpgradeOptions, parallelism, maxRetries int, logger *zap.Logger) *UpgradeManager {
+	if *PAUSEBETWEENBATCHES {
+		parallelism = 1
+	}
+	return &UpgradeManager{
+		ctx:        ctx,
+		prefix:     prefix,
+		tag:        tag,
+		opts:       opts,
+		maxRetries: maxRetries,
+		sem:        make(chan struct{}, parallelism),
+		logger:     logger,
+		jobs:       make(map[string]*upgradeJob),
+	}
+}
+
+// Watch schedules service for upgrade if it isn't already running, and
+// returns a channel of its progress. The channel is closed once the service
+// reaches Done, DryRun or Failed.
+func (m *UpgradeManager) Watch(service string) <-chan Progress {
+	progress := make(chan Progress, 8)
+
+	m.mu.Lock()
+	if job, inFlight := m.jobs[service]; inFlight {
+		job.watchers = append(job.watchers, progress)
+		m.mu.Unlock()
+		return progress
+	}
+	job := &upgradeJob{watchers: []chan Progress{progress}}
+	m.jobs[service] = job
+	m.mu.Unlock()
+
+	go m.run(service, job)
+	return progress
+}
+
+func (m *UpgradeManager) run(service string, job *upgradeJob) {
+	defer m.finish(service, job)
+	m.emit(job, Progress{Service: service, State: Queued})
+
+	imageUuid := m.imageForService(service)
+	opts := m.optsForService(service)
+	logger := m.logger.With(zap.String("service", service), zap.String("image", imageUuid), zap.String("action", "upgrade"))
+
+	resolvedImage, err := resolveImageDigest(m.ctx, logger, imageUuid)
+	if err != nil {
+		m.emit(job, Progress{Service: service, State: Failed, Err: err})
+		return
+	}
+	if *DRYRUN {
+		m.emit(job, Progress{Service: service, State: DryRun})
+		return
+	}
+	imageUuid = resolvedImage
+
+	select {
+	case m.sem <- struct{}{}:
+		defer func() { <-m.sem }()
+	case <-m.ctx.Done():
+		m.emit(job, Progress{Service: service, State: Failed, Err: m.ctx.Err()})
+		return
+	}
+
+	for attempt := 0; attempt <= m.maxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := backoffWithJitter(attempt)
+			logger.Warn("retrying upgrade", zap.Int("attempt", attempt), zap.Int("maxRetries", m.maxRetries), zap.Duration("backoff", backoff))
+			select {
+			case <-time.After(backoff):
+			case <-m.ctx.Done():
+				m.emit(job, Progress{Service: service, State: Failed, Attempt: attempt, Err: m.ctx.Err()})
+				return
+			}
+		}
+
+		m.emit(job, Progress{Service: service, State: Upgrading, Attempt: attempt})
+		if err = doUpgrade(m.ctx, logger, service, imageUuid, opts); err != nil {
+			continue
+		}
+		if err = waitForServiceHealthy(m.ctx, logger, service, *HEALTHTIMEOUT); err != nil {
+			if rbErr := rollbackService(m.ctx, logger, service); rbErr != nil {
+				logger.Error("rollback also failed", zap.Error(rbErr))
+			}
+			continue
+		}
+		if err = waitForFinishUpgradeAvailable(m.ctx, logger, service); err != nil {
+			continue
+		}
+
+		m.emit(job, Progress{Service: service, State: FinishingUpgrade, Attempt: attempt})
+		if err = doFinishUpgrade(m.ctx, logger, service); err != nil {
+			continue
+		}
+		if err = setServiceScale(m.ctx, service, opts); err != nil {
+			continue
+		}
+
+		m.emit(job, Progress{Service: service, State: Done, Attempt: attempt})
+		if err := confirmNextBatch(m.ctx, logger, service); err != nil {
+			logger.Error("error reading operator confirmation", zap.Error(err))
+		}
+		return
+	}
+	m.emit(job, Progress{Service: service, State: Failed, Attempt: m.maxRetries, Err: err})
+}
+
+func (m *UpgradeManager) finish(service string, job *upgradeJob) {
+	m.mu.Lock()
+	delete(m.jobs, service)
+	m.mu.Unlock()
+	for _, w := range job.watchers {
+		close(w)
+	}
+}
+
+// emit delivers p to every watcher of job. Intermediate states are
+// best-effort: a watcher that isn't draining fast enough gets that event
+// dropped rather than stalling the upgrade. Terminal states (Done/DryRun/
+// Failed) are delivered with a blocking send instead, since callers like
+// runManifestEnvironment decide whether dependents proceed based on
+// actually receiving one; the only way out early is m.ctx being canceled.
+func (m *UpgradeManager) emit(job *upgradeJob, p Progress) {
+	m.mu.Lock()
+	watchers := append([]chan Progress{}, job.watchers...)
+	m.mu.Unlock()
+	terminal := p.State == Done || p.State == DryRun || p.State == Failed
+	for _, w := range watchers {
+		if terminal {
+			select {
+			case w <- p:
+			case <-m.ctx.Done():
+				m.logger.Warn("context canceled before terminal progress could be delivered", zap.String("service", p.Service), zap.Stringer("state", p.State))
+			}
+			continue
+		}
+		select {
+		case w <- p:
+		default:
+			m.logger.Warn("progress watcher isn't draining fast enough, dropping event", zap.String("service", p.Service), zap.Stringer("state", p.State))
+		}
+	}
+}
+
+// backoffWithJitter returns an exponential backoff for attempt with up to
+// 50% random jitter, to avoid a thundering herd of simultaneous retries.
+func backoffWithJitter(attempt int) time.Duration {
+	base := time.Second * time.Duration(math.Pow(2, float64(attempt)))
+	jitter := time.Duration(rand.Int63n(int64(base)/2 + 1))
+	return base + jitter
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffWithJitter(t *testing.T) {
+	for attempt := 0; attempt < 6; attempt++ {
+		base := time.Second * time.Duration(math.Pow(2, float64(attempt)))
+		d := backoffWithJitter(attempt)
+		if d < base {
+			t.Fatalf("backoffWithJitter(%d) = %s, want at least the base backoff %s", attempt, d, base)
+		}
+		if d > base+base/2+1 {
+			t.Fatalf("backoffWithJitter(%d) = %s, want at most base + 50%% jitter (%s)", attempt, d, base+base/2)
+		}
+	}
+}
+
+func TestProgressStateString(t *testing.T) {
+	cases := map[ProgressState]string{
+		Queued:            "Queued",
+		Upgrading:         "Upgrading",
+		FinishingUpgrade:  "FinishingUpgrade",
+		Done:              "Done",
+		Failed:            "Failed",
+		DryRun:            "DryRun",
+		ProgressState(99): "Unknown",
+	}
+	for state, want := range cases {
+		if got := state.String(); got != want {
+			t.Fatalf("ProgressState(%d).String() = %q, want %q", state, got, want)
+		}
+	}
+}
+
+func TestProgressStateSucceeded(t *testing.T) {
+	cases := map[ProgressState]bool{
+		Queued:           false,
+		Upgrading:        false,
+		FinishingUpgrade: false,
+		Done:             true,
+		DryRun:           true,
+		Failed:           false,
+	}
+	for state, want := range cases {
+		if got := state.Succeeded(); got != want {
+			t.Fatalf("%s.Succeeded() = %v, want %v", state, got, want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// ManifestService describes one service's upgrade within a manifest
+// Environment. Image/Tag override --image-prefix/--tag for this service;
+// DependsOn lists services that must finish upgrading first.
+type ManifestService struct {
+	Name      string   `yaml:"name"`
+	Image     string   `yaml:"image,omitempty"`
+	Tag       string   `yaml:"tag,omitempty"`
+	BatchSize int64    `yaml:"batch_size,omitempty"`
+	DependsOn []string `yaml:"depends_on,omitempty"`
+}
+
+// ManifestEnvironment targets a single Rancher environment; URL, AccessKey,
+// and SecretKey support ${ENV_VAR} interpolation so a manifest can be
+// checked in without embedding credentials.
+type ManifestEnvironment struct {
+	Name      string            `yaml:"name"`
+	URL       string            `yaml:"url"`
+	AccessKey string            `yaml:"access_key"`
+	SecretKey string            `yaml:"secret_key"`
+	Services  []ManifestService `yaml:"services"`
+}
+
+// Manifest is the top-level --manifest schema: a sequence of environments,
+// each upgraded in order.
+type Manifest struct {
+	Environments []ManifestEnvironment `yaml:"environments"`
+}
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// loadManifest reads, interpolates, and validates a declarative upgrade
+// manifest from path.
+func loadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %w", path, err)
+	}
+	var m Manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+	}
+	for i := range m.Environments {
+		env := &m.Environments[i]
+		env.URL = interpolateEnv(env.URL)
+		env.AccessKey = interpolateEnv(env.AccessKey)
+		env.SecretKey = interpolateEnv(env.SecretKey)
+	}
+	if err := validateManifest(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+func interpolateEnv(s string) string {
+	return envVarPattern.ReplaceAllStringFunc(s, func(match string) string {
+		return os.Getenv(envVarPattern.FindStringSubmatch(match)[1])
+	})
+}
+
+// validateManifest checks required fields and that every depends_on edge
+// names a service that exists in the same environment, and that the
+// resulting dependency graph has no cycles.
+func validateManifest(m *Manifest) error {
+	if len(m.Environments) == 0 {
+		return fmt.Errorf("manifest defines no environments")
+	}
+	for _, env := range m.Environments {
+		if env.Name == "" {
+			return fmt.Errorf("environment missing a name")
+		}
+		if env.URL == "" {
+			return fmt.Errorf("environment %s missing url", env.Name)
+		}
+		if env.AccessKey == "" {
+			return fmt.Errorf("environment %s missing access_key (check its ${ENV_VAR} is set)", env.Name)
+		}
+		if env.SecretKey == "" {
+			return fmt.Errorf("environment %s missing secret_key (check its ${ENV_VAR} is set)", env.Name)
+		}
+		names := make(map[string]bool, len(env.Services))
+		for _, svc := range env.Services {
+			if svc.Name == "" {
+				return fmt.Errorf("environment %s has a service with no name", env.Name)
+			}
+			names[svc.Name] = true
+		}
+		for _, svc := range env.Services {
+			for _, dep := range svc.DependsOn {
+				if !names[dep] {
+					return fmt.Errorf("environment %s: service %s depends_on unknown service %s", env.Name, svc.Name, dep)
+				}
+			}
+		}
+		if _, err := topoSortServices(env.Services); err != nil {
+			return fmt.Errorf("environment %s: %w", env.Name, err)
+		}
+	}
+	return nil
+}
+
+// topoSortServices runs Kahn's algorithm over a manifest environment's
+// depends_on edges, returning the services in dependency order and erroring
+// if the graph has a cycle.
+func topoSortServices(services []ManifestService) ([]ManifestService, error) {
+	byName := make(map[string]ManifestService, len(services))
+	indegree := make(map[string]int, len(services))
+	dependents := make(map[string][]string)
+	for _, svc := range services {
+		byName[svc.Name] = svc
+		if _, ok := indegree[svc.Name]; !ok {
+			indegree[svc.Name] = 0
+		}
+		for _, dep := range svc.DependsOn {
+			indegree[svc.Name]++
+			dependents[dep] = append(dependents[dep], svc.Name)
+		}
+	}
+
+	var queue []string
+	for name, degree := range indegree {
+		if degree == 0 {
+			queue = append(queue, name)
+		}
+	}
+	sort.Strings(queue)
+
+	var ordered []ManifestService
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		ordered = append(ordered, byName[name])
+		var freed []string
+		for _, dependent := range dependents[name] {
+			indegree[dependent]--
+			if indegree[dependent] == 0 {
+				freed = append(freed, dependent)
+			}
+		}
+		sort.Strings(freed)
+		queue = append(queue, freed...)
+	}
+
+	if len(ordered) != len(services) {
+		return nil, fmt.Errorf("depends_on graph has a cycle")
+	}
+	return ordered, nil
+}
+
+// runManifest drives every environment in m, in order.
+func runManifest(ctx context.Context, m *Manifest) error {
+	for _, env := range m.Environments {
+		LOG.Info("starting environment", zap.String("environment", env.Name))
+		if err := runManifestEnvironment(ctx, env); err != nil {
+			return fmt.Errorf("environment %s: %w", env.Name, err)
+		}
+	}
+	return nil
+}
+
+// runManifestEnvironment points the client at env, builds its service map,
+// and dispatches each service to an UpgradeManager as soon as all of its
+// depends_on services have finished upgrading. A service whose dependency
+// didn't complete is skipped rather than upgraded against a stale peer.
+func runManifestEnvironment(ctx context.Context, env ManifestEnvironment) error {
+	*SERVER = env.URL
+	*ACCESSKEY = env.AccessKey
+	*SECRETKEY = env.SecretKey
+	serviceMap, err := createServiceMap(ctx)
+	if err != nil {
+		return fmt.Errorf("building service map: %w", err)
+	}
+	SERVICEMAP = serviceMap
+
+	manager := NewUpgradeManager(ctx, *IMAGEPREFIX, IMAGETAG, upgradeOptionsFromFlags(), *PARALLELISM, *MAXRETRIES, LOG)
+	imageOverrides := make(map[string]string, len(env.Services))
+	batchSizeOverrides := make(map[string]int64, len(env.Services))
+	doneCh := make(map[string]chan struct{}, len(env.Services))
+	for _, svc := range env.Services {
+		doneCh[svc.Name] = make(chan struct{})
+		if svc.Image != "" || svc.Tag != "" {
+			image := *IMAGEPREFIX + svc.Name
+			if svc.Image != "" {
+				image = svc.Image
+			}
+			tag := IMAGETAG
+			if svc.Tag != "" {
+				tag = ":" + svc.Tag
+			}
+			imageOverrides[svc.Name] = image + tag
+		}
+		if svc.BatchSize > 0 {
+			batchSizeOverrides[svc.Name] = svc.BatchSize
+		}
+	}
+	manager.SetOverrides(imageOverrides, batchSizeOverrides)
+
+	var mu sync.Mutex
+	results := make(map[string]ProgressState, len(env.Services))
+	var wg sync.WaitGroup
+	wg.Add(len(env.Services))
+	for _, svc := range env.Services {
+		go func(svc ManifestService) {
+			defer wg.Done()
+			defer close(doneCh[svc.Name])
+
+			for _, dep := range svc.DependsOn {
+				select {
+				case <-doneCh[dep]:
+				case <-ctx.Done():
+					LOG.Error("skipping service, context canceled while waiting on a dependency",
+						zap.String("service", svc.Name), zap.String("dependency", dep))
+					mu.Lock()
+					results[svc.Name] = Failed
+					mu.Unlock()
+					return
+				}
+				mu.Lock()
+				depState := results[dep]
+				mu.Unlock()
+				if !depState.Succeeded() {
+					LOG.Error("skipping service because a dependency did not finish upgrading",
+						zap.String("service", svc.Name), zap.String("dependency", dep))
+					mu.Lock()
+					results[svc.Name] = Failed
+					mu.Unlock()
+					return
+				}
+			}
+
+			var final ProgressState
+			for p := range manager.Watch(svc.Name) {
+				final = p.State
+			}
+			mu.Lock()
+			results[svc.Name] = final
+			mu.Unlock()
+		}(svc)
+	}
+	waitForDrain(ctx, &wg, *SHUTDOWNWAIT)
+
+	var failed []string
+	for name, state := range results {
+		if !state.Succeeded() {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("services failed to upgrade: %v", failed)
+	}
+	return nil
+}
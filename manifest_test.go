@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTopoSortServices(t *testing.T) {
+	t.Run("orders dependents after their dependencies", func(t *testing.T) {
+		services := []ManifestService{
+			{Name: "web", DependsOn: []string{"api"}},
+			{Name: "api", DependsOn: []string{"db"}},
+			{Name: "db"},
+		}
+		ordered, err := topoSortServices(services)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		index := make(map[string]int, len(ordered))
+		for i, svc := range ordered {
+			index[svc.Name] = i
+		}
+		if index["db"] > index["api"] || index["api"] > index["web"] {
+			t.Fatalf("dependency order violated: %v", ordered)
+		}
+	})
+
+	t.Run("detects a cycle", func(t *testing.T) {
+		services := []ManifestService{
+			{Name: "a", DependsOn: []string{"b"}},
+			{Name: "b", DependsOn: []string{"a"}},
+		}
+		if _, err := topoSortServices(services); err == nil {
+			t.Fatal("expected a cycle error, got nil")
+		}
+	})
+}
+
+func TestValidateManifest(t *testing.T) {
+	valid := func() *Manifest {
+		return &Manifest{
+			Environments: []ManifestEnvironment{
+				{
+					Name:      "prod",
+					URL:       "http://rancher.example.com",
+					AccessKey: "key",
+					SecretKey: "secret",
+					Services: []ManifestService{
+						{Name: "api"},
+						{Name: "web", DependsOn: []string{"api"}},
+					},
+				},
+			},
+		}
+	}
+
+	t.Run("accepts a valid manifest", func(t *testing.T) {
+		if err := validateManifest(valid()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rejects an unknown depends_on target", func(t *testing.T) {
+		m := valid()
+		m.Environments[0].Services[1].DependsOn = []string{"missing"}
+		if err := validateManifest(m); err == nil {
+			t.Fatal("expected an error for an unknown depends_on service, got nil")
+		}
+	})
+
+	t.Run("rejects a cycle", func(t *testing.T) {
+		m := valid()
+		m.Environments[0].Services[0].DependsOn = []string{"web"}
+		if err := validateManifest(m); err == nil {
+			t.Fatal("expected a cycle error, got nil")
+		}
+	})
+
+	t.Run("rejects a missing access key", func(t *testing.T) {
+		m := valid()
+		m.Environments[0].AccessKey = ""
+		if err := validateManifest(m); err == nil {
+			t.Fatal("expected an error for a missing access_key, got nil")
+		}
+	})
+
+	t.Run("rejects a missing secret key", func(t *testing.T) {
+		m := valid()
+		m.Environments[0].SecretKey = ""
+		if err := validateManifest(m); err == nil {
+			t.Fatal("expected an error for a missing secret_key, got nil")
+		}
+	})
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	os.Setenv("RANCHER_UPGRADE_TEST_VAR", "swordfish")
+	defer os.Unsetenv("RANCHER_UPGRADE_TEST_VAR")
+
+	got := interpolateEnv("secret is ${RANCHER_UPGRADE_TEST_VAR}")
+	want := "secret is swordfish"
+	if got != want {
+		t.Fatalf("interpolateEnv() = %q, want %q", got, want)
+	}
+
+	if got := interpolateEnv("no vars here"); got != "no vars here" {
+		t.Fatalf("interpolateEnv() = %q, want unchanged input", got)
+	}
+}
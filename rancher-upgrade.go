@@ -1,150 +1,277 @@
 package main
 
 import (
+	"context"
 	"flag"
-	log "github.com/Sirupsen/logrus"
 	rancher "github.com/rancher/go-rancher/client"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	ACCESSKEY   = flag.String("accesskey", "", "Rancher API accesskey.")
-	SECRETKEY   = flag.String("secretkey", "", "Rancher API secretKey.")
-	SERVER      = flag.String("url", "http://localhost:8080", "URL endpoint of the Rancher API.")
-	SERVICEMAP  map[string]string
-	SERVICES    []string
-	IMAGEPREFIX = flag.String("image-prefix", "", "URL for registry plus the repo and any other image prefix.")
-	IMAGETAG    string
-	PARALLELISM = flag.Int("parallelism", 5, "Number of concurrent processes. Defaults to 5.")
-	WG          sync.WaitGroup
+	ACCESSKEY           = flag.String("accesskey", "", "Rancher API accesskey.")
+	SECRETKEY           = flag.String("secretkey", "", "Rancher API secretKey.")
+	SERVER              = flag.String("url", "http://localhost:8080", "URL endpoint of the Rancher API.")
+	SERVICEMAP          map[string]string
+	SERVICES            []string
+	IMAGEPREFIX         = flag.String("image-prefix", "", "URL for registry plus the repo and any other image prefix.")
+	IMAGETAG            string
+	PARALLELISM         = flag.Int("parallelism", 5, "Number of concurrent processes. Defaults to 5.")
+	SHUTDOWNWAIT        = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight upgrades to drain after a shutdown signal.")
+	BATCHSIZE           = flag.Int64("batch-size", 1, "Number of container instances to upgrade at a time within a service.")
+	INTERVAL            = flag.Duration("interval", 2*time.Second, "Interval to wait between upgrade batches within a service.")
+	FINALSCALE          = flag.Int64("final-scale", 0, "Scale to set a service to once its rollout is healthy. 0 leaves the scale unchanged.")
+	UPDATELINKS         = flag.Bool("update-links", false, "Update service links as part of the upgrade.")
+	HEALTHTIMEOUT       = flag.Duration("health-timeout", 60*time.Second, "How long to wait for a service to become healthy before rolling it back.")
+	PAUSEBETWEENBATCHES = flag.Bool("pause-between-batches", false, "Wait for operator confirmation on stdin before upgrading the next service, for canary-style rollouts.")
+	MAXRETRIES          = flag.Int("max-retries", 3, "Number of times to retry a service upgrade before giving up on it.")
+	LOGFORMAT           = flag.String("log-format", "console", "Log output format: json or console.")
+	LOGFILE             = flag.String("log-file", "", "Path to write logs to, with rotation. Defaults to stdout when empty.")
+	REGISTRYUSERNAME    = flag.String("registry-username", "", "Username for registry authentication when resolving mutable tags to a digest.")
+	REGISTRYPASSWORD    = flag.String("registry-password", "", "Password for registry authentication when resolving mutable tags to a digest.")
+	ALLOWMUTABLETAG     = flag.Bool("allow-mutable-tag", false, "Skip digest resolution and upgrade services straight to the given mutable tag.")
+	DRYRUN              = flag.Bool("dry-run", false, "Resolve and print the digest each service would be pinned to, without upgrading anything.")
+	MANIFEST            = flag.String("manifest", "", "Path to a YAML manifest describing environments and services to upgrade, replacing --services/--tag.")
+	WG                  sync.WaitGroup
+	LOG                 *zap.Logger
 )
 
 func main() {
-	log.Info(log.GetLevel().String())
-	upgradeServices(*IMAGEPREFIX, IMAGETAG, SERVICES)
+	defer LOG.Sync()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	installSignalHandler(cancel)
+
+	if *MANIFEST != "" {
+		manifest, err := loadManifest(*MANIFEST)
+		if err != nil {
+			LOG.Fatal("failed loading manifest", zap.Error(err))
+		}
+		if err := runManifest(ctx, manifest); err != nil {
+			LOG.Fatal("manifest run failed", zap.Error(err))
+		}
+		return
+	}
+
+	upgradeServices(ctx, *IMAGEPREFIX, IMAGETAG, SERVICES)
 }
 
-func upgradeServicesConcurrent(prefix, tag string, serviceChan chan string) {
-	// Defer the wait group decrement so it is guaranteed to take place.
-	defer WG.Done()
-	for service := range serviceChan {
-		imageUuid := prefix + service + tag
-		log.Infof("Upgrading %s to %s\n", service, imageUuid)
-		upgradeServiceImage(service, imageUuid)
+// installSignalHandler cancels ctx on SIGINT, SIGTERM, or SIGQUIT so that an
+// in-flight rollout unwinds instead of leaving the Rancher API in a half
+// upgraded state.
+func installSignalHandler(cancel context.CancelFunc) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		sig := <-sigChan
+		LOG.Warn("received signal, shutting down", zap.String("signal", sig.String()))
+		cancel()
+	}()
+}
+
+// waitForDrain waits for wg to drain normally, but once ctx is canceled it
+// gives the in-flight goroutines at most timeout to finish up so a stuck
+// upgrade can't hang the process forever during shutdown. Both the flat
+// --services path (against the global WG) and --manifest (against its own
+// per-environment WaitGroup) route through here so Ctrl-C bounds either one.
+func waitForDrain(ctx context.Context, wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		LOG.Warn("timed out waiting for in-flight upgrades to finish", zap.Duration("timeout", timeout))
 	}
 }
 
-func upgradeServices(prefix, tag string, services []string) {
-	serviceChan := make(chan string, cap(services))
+// upgradeServices submits every service to an UpgradeManager and blocks
+// until each has reached a terminal state, logging its progress along the
+// way. The manager owns deduplication, concurrency limiting, and retries;
+// this is just a thin fan-out over its Watch channels.
+func upgradeServices(ctx context.Context, prefix, tag string, services []string) {
+	manager := NewUpgradeManager(ctx, prefix, tag, upgradeOptionsFromFlags(), *PARALLELISM, *MAXRETRIES, LOG)
 	for _, service := range services {
-		log.Debugf("inserting service %s", service)
-		serviceChan <- service
-	}
-	// We close the channel to *SENDING* here. Receiving can still take place and will not block in `for range` loops.
-	close(serviceChan)
-	for i := 0; i < *PARALLELISM; i++ {
 		WG.Add(1)
-		go upgradeServicesConcurrent(prefix, tag, serviceChan)
+		go upgradeServiceImage(manager, service)
 	}
-	WG.Wait()
+	waitForDrain(ctx, &WG, *SHUTDOWNWAIT)
 }
 
-func upgradeServiceImage(serviceName, image string) {
-	if err := actionAvailable("upgrade", serviceName); err != nil {
-		log.Error(err)
-		return
-	}
-	err := doUpgrade(serviceName, image)
-	if err != nil {
-		log.Errorf("Error trying to upgrade.\n%s", err)
-		return
-	}
-	for err := actionAvailable("finishupgrade", serviceName); err != nil; err = actionAvailable("finishupgrade", serviceName) {
-		time.Sleep(1 * time.Second)
-		log.Debugf(".")
+// upgradeServiceImage submits service to manager and logs each progress
+// event it reports until the upgrade finishes or fails.
+func upgradeServiceImage(manager *UpgradeManager, service string) {
+	defer WG.Done()
+	logger := LOG.With(zap.String("service", service))
+	for p := range manager.Watch(service) {
+		switch p.State {
+		case Queued:
+			logger.Debug("queued for upgrade")
+		case Upgrading:
+			logger.Info("upgrading", zap.Int("attempt", p.Attempt+1))
+		case FinishingUpgrade:
+			logger.Info("finishing upgrade")
+		case Done:
+			logger.Info("upgraded successfully")
+		case DryRun:
+			logger.Info("dry-run: skipped upgrading, no changes made")
+		case Failed:
+			logger.Error("upgrade failed", zap.Int("attempts", p.Attempt+1), zap.Error(p.Err))
+		}
 	}
-	doFinishUpgrade(serviceName)
 }
 
-func actionAvailable(action, service string) error {
-	client, err := getNewClient()
-	if err != nil {
-		// If we can't connect then we're calling the action unavailable.
-		log.Error(err)
+func actionAvailable(ctx context.Context, logger *zap.Logger, action, service string) error {
+	if ctx.Err() != nil {
 		return &actionAvailableError{action, service}
 	}
 	if SERVICEMAP[service] == "" {
 		return &actionAvailableError{action, service}
 	}
-	s, err := client.Service.ById(SERVICEMAP[service])
-	if err != nil {
-		log.Error(err)
-		return &actionAvailableError{action, service}
-	}
-	_, ok := s.Resource.Actions[action]
-	if !ok {
+	available := false
+	err := withContext(ctx, func() error {
+		client, err := newRancherClient()
+		if err != nil {
+			// If we can't connect then we're calling the action unavailable.
+			logger.Error("error connecting to rancher", zap.Error(err))
+			return err
+		}
+		s, err := client.Service.ById(SERVICEMAP[service])
+		if err != nil {
+			logger.Error("error fetching service", zap.Error(err))
+			return err
+		}
+		_, available = s.Resource.Actions[action]
+		return nil
+	})
+	if err != nil || !available {
 		return &actionAvailableError{action, service}
 	}
 	return nil
 }
 
-func doFinishUpgrade(service string) error {
-	if err := actionAvailable("finishupgrade", service); err != nil {
-		return &upgradeError{"finishupgrade", service, err}
+func doFinishUpgrade(ctx context.Context, logger *zap.Logger, service string) error {
+	if ctx.Err() != nil {
+		return &upgradeError{"finishupgrade", service, ctx.Err()}
 	}
-	log.Infof("Finishing Upgrade on %s.", service)
-	client, err := getNewClient()
-	if err != nil {
+	if err := actionAvailable(ctx, logger, "finishupgrade", service); err != nil {
 		return &upgradeError{"finishupgrade", service, err}
 	}
+	logger.Info("finishing upgrade")
 	if SERVICEMAP[service] == "" {
-		return &actionAvailableError{action, service}
+		return &actionAvailableError{"finishupgrade", service}
 	}
-	s, err := client.Service.ById(SERVICEMAP[service])
-	if err != nil {
-		return &upgradeError{"finishupgrade", service, err}
-	}
-	_, err = client.Service.ActionFinishupgrade(s)
+	err := withContext(ctx, func() error {
+		client, err := newRancherClient()
+		if err != nil {
+			return err
+		}
+		s, err := client.Service.ById(SERVICEMAP[service])
+		if err != nil {
+			return err
+		}
+		_, err = client.Service.ActionFinishupgrade(s)
+		return err
+	})
 	if err != nil {
 		return &upgradeError{"finishupgrade", service, err}
 	}
 	return nil
 }
 
-func doUpgrade(serviceName, image string) error {
-	if err := actionAvailable("upgrade", serviceName); err != nil {
-		return &actionAvailableError{"upgrade", serviceName}
+func doUpgrade(ctx context.Context, logger *zap.Logger, serviceName, image string, opts *UpgradeOptions) error {
+	if ctx.Err() != nil {
+		return &upgradeError{"upgrade", serviceName, ctx.Err()}
 	}
-	log.Infof("Upgrading Service %s.", serviceName)
-	client, err := getNewClient()
-	if err != nil {
-		return &upgradeError{"getNewClient", serviceName, err}
+	if err := actionAvailable(ctx, logger, "upgrade", serviceName); err != nil {
+		return &actionAvailableError{"upgrade", serviceName}
 	}
-	// Get Service object
+	logger.Info("upgrading service")
 	if SERVICEMAP[serviceName] == "" {
-		return &actionAvailableError{action, serviceName}
-	}
-	service, err := client.Service.ById(SERVICEMAP[serviceName])
-	if err != nil {
-		return &upgradeError{"client.Service.ById", serviceName, err}
+		return &actionAvailableError{"upgrade", serviceName}
 	}
+	// fn builds its own *upgradeError (with the stage that failed) entirely
+	// on its own goroutine and hands it back through withContext's channel;
+	// nothing is shared with the caller's goroutine if ctx wins the race
+	// instead.
+	err := withContext(ctx, func() error {
+		client, err := newRancherClient()
+		if err != nil {
+			return &upgradeError{"getNewClient", serviceName, err}
+		}
+		service, err := client.Service.ById(SERVICEMAP[serviceName])
+		if err != nil {
+			return &upgradeError{"client.Service.ById", serviceName, err}
+		}
 
-	// Update settings
-	service.Upgrade.InServiceStrategy.StartFirst = true
-	service.Upgrade.InServiceStrategy.LaunchConfig.ImageUuid = "docker:" + image
+		// Update settings
+		service.Upgrade.InServiceStrategy.StartFirst = true
+		service.Upgrade.InServiceStrategy.LaunchConfig.ImageUuid = "docker:" + image
+		service.Upgrade.InServiceStrategy.BatchSize = opts.BatchSize
+		service.Upgrade.InServiceStrategy.IntervalMillis = opts.IntervalMillis
+		service.Upgrade.InServiceStrategy.UpdateLinks = opts.UpdateLinks
 
-	// Perform Upgrade
-	service, err = client.Service.ActionUpgrade(service, service.Upgrade)
+		// Perform Upgrade
+		if _, err := client.Service.ActionUpgrade(service, service.Upgrade); err != nil {
+			return &upgradeError{"client.Service.ActionUpgrade", serviceName, err}
+		}
+		return nil
+	})
 	if err != nil {
-		return &upgradeError{"client.Service.ActionUpgrade", serviceName, err}
+		if ue, ok := err.(*upgradeError); ok {
+			return ue
+		}
+		return &upgradeError{"upgrade", serviceName, err}
 	}
 	return nil
 }
 
-func getNewClient() (*rancher.RancherClient, error) {
-	var client, err = rancher.NewRancherClient(&rancher.ClientOpts{Url: *SERVER, AccessKey: *ACCESSKEY, SecretKey: *SECRETKEY})
+// withContext runs fn on its own goroutine and returns as soon as either fn
+// completes or ctx is canceled, so a Rancher API call that hangs mid-flight
+// no longer blocks a Ctrl-C from unwinding the rollout. The goroutine is
+// left to finish in the background if ctx wins the race.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newRancherClient builds a Rancher API client from the global connection
+// flags. It performs no I/O of its own, but go-rancher's constructor fetches
+// the API schema, so callers that need to honor ctx should run it through
+// withContext (see getNewClient) rather than calling it directly.
+func newRancherClient() (*rancher.RancherClient, error) {
+	return rancher.NewRancherClient(&rancher.ClientOpts{Url: *SERVER, AccessKey: *ACCESSKEY, SecretKey: *SECRETKEY})
+}
+
+// getNewClient builds a Rancher API client, racing the schema fetch against
+// ctx so a canceled context doesn't leave a caller blocked on a hung connect.
+func getNewClient(ctx context.Context) (*rancher.RancherClient, error) {
+	var client *rancher.RancherClient
+	err := withContext(ctx, func() error {
+		var err error
+		client, err = newRancherClient()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -158,53 +285,45 @@ func init() {
 	flag.StringVar(&tag, "tag", "latest", "Tag to use for the images.")
 	logLevel := flag.String("log", "Info", "Log level. Defaults to Info.")
 	flag.Parse()
-	InitializeLogging(*logLevel)
+	LOG = InitializeLogging(*logLevel, *LOGFORMAT, *LOGFILE)
 	SERVICES = strings.Split(services, ",")
 	if !strings.HasPrefix(tag, ":") {
 		tag = ":" + tag
 	}
 	IMAGETAG = tag
+	// Manifest mode points at a different environment per entry, so it
+	// builds its own service map once it knows which one; skip it here.
+	if *MANIFEST != "" {
+		return
+	}
 	// Do this after parsing flags since it uses them...
 	var err error
-	SERVICEMAP, err = createServiceMap()
+	SERVICEMAP, err = createServiceMap(context.Background())
 	if err != nil {
-		log.Fatalf("Failed creating the service map.\n%s", err)
+		LOG.Fatal("failed creating the service map", zap.Error(err))
 	}
 }
 
-func createServiceMap() (map[string]string, error) {
-	client, err := getNewClient()
-	if err != nil {
-		return nil, err
-	}
-	var lOpts rancher.ListOpts
-	serviceCollection, err := client.Service.List(&lOpts)
+func createServiceMap(ctx context.Context) (map[string]string, error) {
+	var serviceMap map[string]string
+	err := withContext(ctx, func() error {
+		client, err := newRancherClient()
+		if err != nil {
+			return err
+		}
+		var lOpts rancher.ListOpts
+		serviceCollection, err := client.Service.List(&lOpts)
+		if err != nil {
+			return err
+		}
+		serviceMap = make(map[string]string)
+		for _, service := range serviceCollection.Data {
+			serviceMap[service.Name] = service.Id
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	var serviceMap = make(map[string]string)
-	for _, service := range serviceCollection.Data {
-		serviceMap[service.Name] = service.Id
-	}
 	return serviceMap, nil
 }
-
-func InitializeLogging(logLevel string) {
-	switch logLevel {
-	case "panic":
-		log.SetLevel(log.PanicLevel)
-	case "fatal":
-		log.SetLevel(log.FatalLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	case "warn":
-		log.SetLevel(log.WarnLevel)
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "info":
-		fallthrough
-	default:
-		log.SetLevel(log.InfoLevel)
-	}
-}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const manifestV2MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// resolveImageDigest takes an image reference like "quay.io/acme/widget:latest"
+// and, unless the tag is already pinned to a digest or --allow-mutable-tag is
+// set, queries the Docker Registry HTTP API v2 for the manifest digest and
+// rewrites the reference to "<repo>@sha256:<digest>" so every service in a
+// run lands on the exact same image, closing the race where a mutable tag
+// shifts mid-rollout.
+func resolveImageDigest(ctx context.Context, logger *zap.Logger, imageRef string) (string, error) {
+	repo, tag, ok := splitImageTag(imageRef)
+	if !ok || *ALLOWMUTABLETAG {
+		if *DRYRUN {
+			logger.Info("dry-run: would upgrade to image as-is, digest resolution skipped", zap.String("image", imageRef))
+		}
+		return imageRef, nil
+	}
+
+	host, repoPath := splitRegistryHost(repo)
+	digest, err := fetchManifestDigest(ctx, host, repoPath, tag, *REGISTRYUSERNAME, *REGISTRYPASSWORD)
+	if err != nil {
+		return "", &upgradeError{"resolveImageDigest", imageRef, err}
+	}
+
+	resolved := fmt.Sprintf("%s@%s", repo, digest)
+	if *DRYRUN {
+		logger.Info("dry-run: resolved mutable tag to digest", zap.String("tag", imageRef), zap.String("resolved", resolved))
+	} else {
+		logger.Info("pinned mutable tag to digest", zap.String("tag", imageRef), zap.String("resolved", resolved))
+	}
+	return resolved, nil
+}
+
+// splitImageTag splits "repo:tag" into repo and tag, reporting ok=false when
+// the reference is already pinned to a digest (repo@sha256:...) or carries
+// no tag at all.
+func splitImageTag(imageRef string) (repo, tag string, ok bool) {
+	if strings.Contains(imageRef, "@") {
+		return imageRef, "", false
+	}
+	idx := strings.LastIndex(imageRef, ":")
+	if idx == -1 {
+		return imageRef, "", false
+	}
+	// A ":" before the last "/" is the registry's ":port", not a tag.
+	if strings.Contains(imageRef[idx:], "/") {
+		return imageRef, "", false
+	}
+	return imageRef[:idx], imageRef[idx+1:], true
+}
+
+// splitRegistryHost splits a repo reference into its registry host and
+// repository path, defaulting to Docker Hub when no host is present. A bare,
+// single-segment repo (e.g. "redis") is an official Docker Hub image, which
+// Hub only serves under the "library/" namespace.
+func splitRegistryHost(repo string) (host, path string) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 2 && (strings.Contains(parts[0], ".") || strings.Contains(parts[0], ":") || parts[0] == "localhost") {
+		return parts[0], parts[1]
+	}
+	if len(parts) == 1 {
+		return "registry-1.docker.io", "library/" + repo
+	}
+	return "registry-1.docker.io", repo
+}
+
+// fetchManifestDigest performs the Docker Registry HTTP API v2 manifest
+// HEAD-equivalent GET, retrying once if the registry challenges with a 401:
+// a Bearer challenge goes through the token flow in authenticate, a Basic
+// challenge retries the same request with HTTP Basic auth.
+func fetchManifestDigest(ctx context.Context, host, repo, tag, username, password string) (string, error) {
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo, tag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", manifestV2MediaType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if strings.HasPrefix(challenge, "Basic ") {
+			req.SetBasicAuth(username, password)
+		} else {
+			token, err := authenticate(ctx, challenge, username, password)
+			if err != nil {
+				return "", err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s resolving %s:%s", resp.Status, repo, tag)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry response for %s:%s had no Docker-Content-Digest header", repo, tag)
+	}
+	return digest, nil
+}
+
+// authenticate performs the Bearer token flow described by a
+// `Bearer realm="...",service="...",scope="..."` WWW-Authenticate
+// challenge, using HTTP Basic auth against the realm when credentials are
+// supplied.
+func authenticate(ctx context.Context, challenge, username, password string) (string, error) {
+	realm, params, err := parseChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm, nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	for k, v := range params {
+		if k == "realm" {
+			continue
+		}
+		q.Set(k, v)
+	}
+	req.URL.RawQuery = q.Encode()
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request to %s failed with status %s", realm, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// parseChallenge parses a Bearer WWW-Authenticate header into its realm URL
+// and the rest of its parameters.
+func parseChallenge(challenge string) (string, map[string]string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", nil, fmt.Errorf("unsupported auth challenge: %s", challenge)
+	}
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	realm, ok := params["realm"]
+	if !ok {
+		return "", nil, fmt.Errorf("auth challenge missing realm: %s", challenge)
+	}
+	return realm, params, nil
+}
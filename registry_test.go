@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestSplitImageTag(t *testing.T) {
+	cases := []struct {
+		name     string
+		imageRef string
+		repo     string
+		tag      string
+		ok       bool
+	}{
+		{"tagged", "quay.io/acme/widget:latest", "quay.io/acme/widget", "latest", true},
+		{"digest pinned", "quay.io/acme/widget@sha256:abc123", "", "", false},
+		{"no tag", "quay.io/acme/widget", "", "", false},
+		{"registry port, no tag", "localhost:5000/widget", "", "", false},
+		{"registry port with tag", "localhost:5000/widget:v2", "localhost:5000/widget", "v2", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			repo, tag, ok := splitImageTag(c.imageRef)
+			if ok != c.ok {
+				t.Fatalf("splitImageTag(%q) ok = %v, want %v", c.imageRef, ok, c.ok)
+			}
+			if !ok {
+				return
+			}
+			if repo != c.repo || tag != c.tag {
+				t.Fatalf("splitImageTag(%q) = (%q, %q), want (%q, %q)", c.imageRef, repo, tag, c.repo, c.tag)
+			}
+		})
+	}
+}
+
+func TestSplitRegistryHost(t *testing.T) {
+	cases := []struct {
+		name string
+		repo string
+		host string
+		path string
+	}{
+		{"bare docker hub image", "redis", "registry-1.docker.io", "library/redis"},
+		{"namespaced docker hub image", "myuser/redis", "registry-1.docker.io", "myuser/redis"},
+		{"private registry with dot", "quay.io/acme/widget", "quay.io", "acme/widget"},
+		{"private registry with port", "localhost:5000/widget", "localhost:5000", "widget"},
+		{"explicit localhost", "localhost/widget", "localhost", "widget"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			host, path := splitRegistryHost(c.repo)
+			if host != c.host || path != c.path {
+				t.Fatalf("splitRegistryHost(%q) = (%q, %q), want (%q, %q)", c.repo, host, path, c.host, c.path)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	t.Run("bearer challenge", func(t *testing.T) {
+		challenge := `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/redis:pull"`
+		realm, params, err := parseChallenge(challenge)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if realm != "https://auth.docker.io/token" {
+			t.Fatalf("realm = %q, want %q", realm, "https://auth.docker.io/token")
+		}
+		if params["service"] != "registry.docker.io" {
+			t.Fatalf("service = %q, want %q", params["service"], "registry.docker.io")
+		}
+		if params["scope"] != "repository:library/redis:pull" {
+			t.Fatalf("scope = %q, want %q", params["scope"], "repository:library/redis:pull")
+		}
+	})
+
+	t.Run("basic challenge is unsupported here", func(t *testing.T) {
+		if _, _, err := parseChallenge(`Basic realm="registry"`); err == nil {
+			t.Fatal("expected an error for a Basic challenge, got nil")
+		}
+	})
+
+	t.Run("bearer challenge missing realm", func(t *testing.T) {
+		if _, _, err := parseChallenge(`Bearer service="registry.docker.io"`); err == nil {
+			t.Fatal("expected an error for a challenge missing realm, got nil")
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	rancher "github.com/rancher/go-rancher/client"
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+// UpgradeOptions configures the rolling upgrade strategy applied to a
+// service, modeled after libcompose's ServiceUpgrade.
+type UpgradeOptions struct {
+	BatchSize      int64
+	FinalScale     int64
+	UpdateLinks    bool
+	IntervalMillis int64
+}
+
+// upgradeOptionsFromFlags builds the default UpgradeOptions for upgrades in
+// this run; a --manifest service's batch_size overrides BatchSize.
+func upgradeOptionsFromFlags() *UpgradeOptions {
+	return &UpgradeOptions{
+		BatchSize:      *BATCHSIZE,
+		FinalScale:     *FINALSCALE,
+		UpdateLinks:    *UPDATELINKS,
+		IntervalMillis: int64(*INTERVAL / time.Millisecond),
+	}
+}
+
+// waitForServiceHealthy polls serviceName until Rancher reports it upgraded
+// and healthy, or returns a *healthTimeoutError once timeout elapses.
+func waitForServiceHealthy(ctx context.Context, logger *zap.Logger, serviceName string, timeout time.Duration) error {
+	client, err := getNewClient(ctx)
+	if err != nil {
+		return &upgradeError{"waitForServiceHealthy", serviceName, err}
+	}
+	if SERVICEMAP[serviceName] == "" {
+		return &actionAvailableError{"healthcheck", serviceName}
+	}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return &upgradeError{"waitForServiceHealthy", serviceName, ctx.Err()}
+		case <-deadline:
+			return &healthTimeoutError{serviceName, timeout}
+		case <-time.After(2 * time.Second):
+			var s *rancher.Service
+			err := withContext(ctx, func() error {
+				var err error
+				s, err = client.Service.ById(SERVICEMAP[serviceName])
+				return err
+			})
+			if err != nil {
+				logger.Error("error polling service health", zap.Error(err))
+				continue
+			}
+			logger.Debug("polled service health", zap.String("state", s.State), zap.String("healthState", s.HealthState))
+			if s.State == "upgraded" && s.HealthState == "healthy" {
+				return nil
+			}
+		}
+	}
+}
+
+// waitForFinishUpgradeAvailable polls until Rancher exposes the
+// finishupgrade action for serviceName, replacing the old "." heartbeat
+// with a single structured log line reporting how long it waited.
+func waitForFinishUpgradeAvailable(ctx context.Context, logger *zap.Logger, serviceName string) error {
+	start := time.Now()
+	for {
+		err := actionAvailable(ctx, logger, "finishupgrade", serviceName)
+		if err == nil {
+			logger.Debug("finishupgrade became available", zap.Duration("elapsed", time.Since(start)))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// rollbackService invokes the service's rollback action, mirroring
+// doFinishUpgrade but for ActionRollback.
+func rollbackService(ctx context.Context, logger *zap.Logger, serviceName string) error {
+	if err := actionAvailable(ctx, logger, "rollback", serviceName); err != nil {
+		return &upgradeError{"rollback", serviceName, err}
+	}
+	logger.Warn("rolling back service")
+	err := withContext(ctx, func() error {
+		client, err := newRancherClient()
+		if err != nil {
+			return err
+		}
+		s, err := client.Service.ById(SERVICEMAP[serviceName])
+		if err != nil {
+			return err
+		}
+		_, err = client.Service.ActionRollback(s)
+		return err
+	})
+	if err != nil {
+		return &upgradeError{"rollback", serviceName, err}
+	}
+	return nil
+}
+
+// setServiceScale applies opts.FinalScale once a rollout has completed
+// successfully. A FinalScale of 0 means "leave the scale as-is".
+func setServiceScale(ctx context.Context, serviceName string, opts *UpgradeOptions) error {
+	if opts.FinalScale <= 0 {
+		return nil
+	}
+	err := withContext(ctx, func() error {
+		client, err := newRancherClient()
+		if err != nil {
+			return err
+		}
+		s, err := client.Service.ById(SERVICEMAP[serviceName])
+		if err != nil {
+			return err
+		}
+		s.Scale = opts.FinalScale
+		_, err = client.Service.Update(s, s)
+		return err
+	})
+	if err != nil {
+		return &upgradeError{"setServiceScale", serviceName, err}
+	}
+	return nil
+}
+
+// confirmNextBatch blocks on stdin when --pause-between-batches is set,
+// letting an operator drive a canary-style rollout one service at a time.
+// The read runs on its own goroutine so a Ctrl-C while waiting on the
+// operator still cancels ctx and returns promptly instead of hanging the
+// process forever.
+func confirmNextBatch(ctx context.Context, logger *zap.Logger, serviceName string) error {
+	if !*PAUSEBETWEENBATCHES {
+		return nil
+	}
+	logger.Info("service healthy, waiting for operator confirmation to continue rollout")
+	return withContext(ctx, func() error {
+		reader := bufio.NewReader(os.Stdin)
+		_, err := reader.ReadString('\n')
+		return err
+	})
+}